@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// MetricMetadata carries the subset of a target's metadata that sampleBuilder needs to turn a
+// sample into a Stackdriver point: the Prometheus metric name, its declared type, and the
+// Stackdriver value type its MetricDescriptor was created with.
+type MetricMetadata struct {
+	Metric     string
+	MetricType textparse.MetricType
+	ValueType  metric_pb.MetricDescriptor_ValueType
+}
+
+// resetTracker watches a raw, not-yet-reset-adjusted series for counter resets as samples come in.
+type resetTracker interface {
+	newPoint(ctx context.Context, lset tsdbLabels.Labels, t int64, v float64)
+}
+
+// seriesCacheEntry is everything sampleBuilder needs to know about a single TSDB series: its
+// labels, how to classify and export it, and the cached state that carries over between samples.
+type seriesCacheEntry struct {
+	lset     tsdbLabels.Labels
+	suffix   string
+	hash     uint64
+	exported bool
+	metadata MetricMetadata
+	proto    *monitoring_pb.TimeSeries
+	tracker  resetTracker
+
+	// nativeHistogram and zeroThreshold are populated from a series' metadata when it's a
+	// Prometheus native (sparse) histogram rather than a classic le/_bucket one; see
+	// buildNativeDistribution.
+	nativeHistogram bool
+	zeroThreshold   float64
+}
+
+// seriesGetter is sampleBuilder's view into the series cache: per-series metadata lookups and the
+// counter/summary/histogram reset-detection heuristics that back the extraction logic in
+// transform.go.
+type seriesGetter interface {
+	// get returns the cached entry for ref, or ok=false if ref is unknown, e.g. it belongs to a
+	// series Prometheus dropped before we scraped it.
+	get(ctx context.Context, ref uint64) (*seriesCacheEntry, bool, error)
+
+	// getResetAdjusted returns the reset timestamp and reset-adjusted value for a counter-like
+	// series, detecting resets from value drops. ok is false if no reset has been observed yet.
+	getResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool)
+
+	// updateSampleInterval records that a sample for hash was just built spanning
+	// [resetTimestamp, t], returning false if the point should be dropped, e.g. because the
+	// interval is degenerate.
+	updateSampleInterval(hash uint64, resetTimestamp, t int64) bool
+
+	// getHistogram returns the native histogram value recorded for ref at timestamp t.
+	getHistogram(ref uint64, t int64) (*histogram.Histogram, bool)
+
+	// setResetTimestamp and resetTimestamp store and retrieve the reset timestamp associated
+	// with hash directly, for series such as native histograms that carry their own reset hint
+	// instead of relying on getResetAdjusted's value-drop heuristic.
+	setResetTimestamp(hash uint64, t int64)
+	resetTimestamp(hash uint64) int64
+
+	// getCreatedTimestamp returns the most recently cached OpenMetrics _created value, in float
+	// unix seconds, for the series identified by metric name and label set (with the _created
+	// suffix and any quantile/le label already stripped), and ok=false if none has been scraped.
+	getCreatedTimestamp(metric string, lset tsdbLabels.Labels) (float64, bool)
+
+	// getExemplar returns the most recent exemplar buffered for ref since the last flush, and
+	// ok=false if sendExemplars is off or none was recorded.
+	getExemplar(ref uint64) (exemplarData, bool)
+}
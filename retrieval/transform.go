@@ -15,14 +15,18 @@ package retrieval
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/golang/protobuf/proto"
+	any_pb "github.com/golang/protobuf/ptypes/any"
 	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/histogram"
 	"github.com/prometheus/prometheus/pkg/textparse"
 	"github.com/prometheus/tsdb"
 	tsdbLabels "github.com/prometheus/tsdb/labels"
@@ -31,8 +35,38 @@ import (
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
+// spanContextTypeURL is the Any type URL Cloud Monitoring expects for a distribution exemplar
+// attachment that links a point back to the trace it was sampled from.
+const spanContextTypeURL = "type.googleapis.com/google.monitoring.v3.SpanContext"
+
 type sampleBuilder struct {
 	series seriesGetter
+	// useCreatedTimestamps mirrors the --use-created-timestamps flag. When set, a counter,
+	// summary, or histogram's OpenMetrics _created series is preferred over getResetAdjusted's
+	// value-drop heuristic for determining the Stackdriver start time.
+	useCreatedTimestamps bool
+	// sendExemplars mirrors the --send-exemplars flag. When set, buffered Prometheus exemplars are
+	// attached to the distribution points sampleBuilder emits. Counter/gauge points are NOT covered:
+	// monitoring_pb.Point/TypedValue carry no Exemplars field in the Cloud Monitoring API today, so
+	// there is nowhere on a scalar point to put one. This is a known gap versus the original ask for
+	// exemplars on scalar counters, not an oversight; revisit if the API ever grows the field.
+	sendExemplars bool
+	// summaryAsDistribution mirrors the --summary-as-distribution flag. When set, a summary's
+	// quantiles are folded into a single Distribution instead of being split into N+2 series.
+	summaryAsDistribution bool
+}
+
+// newSampleBuilder wires the --use-created-timestamps, --send-exemplars, and
+// --summary-as-distribution flags into a sampleBuilder. It's the seam main would call through
+// after registering those flags; this tree ships retrieval as a library with no cmd package, so
+// there is nowhere to actually register them yet.
+func newSampleBuilder(series seriesGetter, useCreatedTimestamps, sendExemplars, summaryAsDistribution bool) *sampleBuilder {
+	return &sampleBuilder{
+		series:                series,
+		useCreatedTimestamps:  useCreatedTimestamps,
+		sendExemplars:         sendExemplars,
+		summaryAsDistribution: summaryAsDistribution,
+	}
 }
 
 // next extracts the next sample from the TSDB input sample list and returns
@@ -60,6 +94,11 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 	if !entry.exported {
 		return nil, 0, tailSamples, nil
 	}
+	// _created series only carry a reset timestamp for resetTimestampAdjusted to consume; they
+	// have no business being shipped to Stackdriver as a point of their own.
+	if entry.suffix == metricSuffixCreated {
+		return nil, 0, tailSamples, nil
+	}
 	// Get a shallow copy of the proto so we can overwrite the point field
 	// and safely send it into the remote queues.
 	ts := *entry.proto
@@ -73,10 +112,13 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 
 	var resetTimestamp int64
 
+	// Scalar exemplars (counter/gauge) have nowhere to go: monitoring_pb.Point/TypedValue carry no
+	// Exemplars field in the Cloud Monitoring API today, only Distribution does. sendExemplars only
+	// ever reaches buildDistribution's per-bucket exemplars below.
 	switch entry.metadata.MetricType {
 	case textparse.MetricTypeCounter:
 		var v float64
-		resetTimestamp, v, ok = b.series.getResetAdjusted(sample.Ref, sample.T, sample.V)
+		resetTimestamp, v, ok = b.resetTimestampAdjusted(entry, sample.Ref, sample.T, sample.V)
 		if !ok {
 			return nil, 0, tailSamples, nil
 		}
@@ -87,10 +129,22 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 		point.Value = buildTypedValue(entry.metadata.ValueType, sample.V)
 
 	case textparse.MetricTypeSummary:
+		if b.summaryAsDistribution {
+			var v *distribution_pb.Distribution
+			v, resetTimestamp, tailSamples, err = b.buildSummaryDistribution(ctx, entry.metadata.Metric, entry.lset, samples)
+			if v == nil || err != nil {
+				return nil, 0, tailSamples, err
+			}
+			point.Interval.StartTime = getTimestamp(resetTimestamp)
+			point.Value = &monitoring_pb.TypedValue{
+				Value: &monitoring_pb.TypedValue_DistributionValue{v},
+			}
+			break
+		}
 		switch entry.suffix {
 		case metricSuffixSum:
 			var v float64
-			resetTimestamp, v, ok = b.series.getResetAdjusted(sample.Ref, sample.T, sample.V)
+			resetTimestamp, v, ok = b.resetTimestampAdjusted(entry, sample.Ref, sample.T, sample.V)
 			if !ok {
 				return nil, 0, tailSamples, nil
 			}
@@ -98,7 +152,7 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 			point.Value = &monitoring_pb.TypedValue{Value: &monitoring_pb.TypedValue_DoubleValue{v}}
 		case metricSuffixCount:
 			var v float64
-			resetTimestamp, v, ok = b.series.getResetAdjusted(sample.Ref, sample.T, sample.V)
+			resetTimestamp, v, ok = b.resetTimestampAdjusted(entry, sample.Ref, sample.T, sample.V)
 			if !ok {
 				return nil, 0, tailSamples, nil
 			}
@@ -111,12 +165,22 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 		}
 
 	case textparse.MetricTypeHistogram:
-		// We pass in the original lset for matching since Prometheus's target label must
-		// be the same as well.
 		var v *distribution_pb.Distribution
-		v, resetTimestamp, tailSamples, err = b.buildDistribution(ctx, entry.metadata.Metric, entry.lset, samples)
-		if v == nil || err != nil {
-			return nil, 0, tailSamples, err
+		if entry.nativeHistogram {
+			// Native histograms carry their full exponential bucket layout on
+			// a single series, so there are no sibling le/_sum/_count series
+			// to sweep up: the distribution comes straight off the sample.
+			v, resetTimestamp, ok = b.buildNativeDistribution(entry, sample)
+			if !ok {
+				return nil, 0, tailSamples, nil
+			}
+		} else {
+			// We pass in the original lset for matching since Prometheus's target label must
+			// be the same as well.
+			v, resetTimestamp, tailSamples, err = b.buildDistribution(ctx, entry.metadata.Metric, entry.lset, samples)
+			if v == nil || err != nil {
+				return nil, 0, tailSamples, err
+			}
 		}
 		point.Interval.StartTime = getTimestamp(resetTimestamp)
 		point.Value = &monitoring_pb.TypedValue{
@@ -134,12 +198,16 @@ func (b *sampleBuilder) next(ctx context.Context, samples []tsdb.RefSample) (*mo
 }
 
 const (
-	metricSuffixBucket = "_bucket"
-	metricSuffixSum    = "_sum"
-	metricSuffixCount  = "_count"
-	metricSuffixTotal  = "_total"
+	metricSuffixBucket  = "_bucket"
+	metricSuffixSum     = "_sum"
+	metricSuffixCount   = "_count"
+	metricSuffixTotal   = "_total"
+	metricSuffixCreated = "_created"
 )
 
+// stripComplexMetricSuffix splits a classic histogram or summary series into its base metric name
+// and suffix. Native histograms are a single series with no le/_sum/_count siblings, so seriesCache
+// routes them around this dispatch entirely once it recognizes them from their metadata.
 func stripComplexMetricSuffix(name string) (prefix string, suffix string, ok bool) {
 	if strings.HasSuffix(name, metricSuffixBucket) {
 		return name[:len(name)-len(metricSuffixBucket)], metricSuffixBucket, true
@@ -153,9 +221,30 @@ func stripComplexMetricSuffix(name string) (prefix string, suffix string, ok boo
 	if strings.HasSuffix(name, metricSuffixTotal) {
 		return name[:len(name)-len(metricSuffixTotal)], metricSuffixTotal, true
 	}
+	// _created carries an OpenMetrics reset timestamp rather than a value to export; callers
+	// route it to the createdTimestamps cache instead of treating it like _sum/_count/_bucket.
+	if strings.HasSuffix(name, metricSuffixCreated) {
+		return name[:len(name)-len(metricSuffixCreated)], metricSuffixCreated, true
+	}
 	return name, "", false
 }
 
+// resetTimestampAdjusted returns the reset timestamp and possibly-adjusted value to use for a
+// counter, summary _sum/_count, or histogram _count sample. With --use-created-timestamps set, an
+// OpenMetrics _created series cached for this metric is authoritative and wins over the value-drop
+// heuristic in getResetAdjusted, as long as it isn't newer than the sample it's backing.
+func (b *sampleBuilder) resetTimestampAdjusted(entry *seriesCacheEntry, ref uint64, t int64, v float64) (int64, float64, bool) {
+	if b.useCreatedTimestamps {
+		if created, ok := b.series.getCreatedTimestamp(entry.metadata.Metric, entry.lset); ok {
+			createdMs := int64(created * 1000)
+			if createdMs <= t {
+				return createdMs, v, true
+			}
+		}
+	}
+	return b.series.getResetAdjusted(ref, t, v)
+}
+
 const (
 	maxLabelCount = 10
 	metricsPrefix = "external.googleapis.com/prometheus"
@@ -179,6 +268,10 @@ func getTimestamp(t int64) *timestamp_pb.Timestamp {
 type distribution struct {
 	bounds []float64
 	values []int64
+	// exemplars holds, for each bucket in bounds, the most recent exemplar observed on that
+	// bucket's series since the last flush, or nil if sendExemplars is off or none was recorded.
+	// It stays in lock-step with bounds/values through sorting so indices keep lining up.
+	exemplars []*distribution_pb.Distribution_Exemplar
 }
 
 func (d *distribution) Len() int {
@@ -192,6 +285,25 @@ func (d *distribution) Less(i, j int) bool {
 func (d *distribution) Swap(i, j int) {
 	d.bounds[i], d.bounds[j] = d.bounds[j], d.bounds[i]
 	d.values[i], d.values[j] = d.values[j], d.values[i]
+	d.exemplars[i], d.exemplars[j] = d.exemplars[j], d.exemplars[i]
+}
+
+// byQuantile sorts a distribution of quantile samples by quantile fraction rather than by observed
+// value, keeping the parallel quantiles slice in lock-step through the swap. buildSummaryDistribution
+// needs the distribution's bounds to end up in quantile order even though they hold observed values,
+// since the count-reconstruction math walks consecutive quantile gaps.
+type byQuantile struct {
+	*distribution
+	quantiles []float64
+}
+
+func (q byQuantile) Less(i, j int) bool {
+	return q.quantiles[i] < q.quantiles[j]
+}
+
+func (q byQuantile) Swap(i, j int) {
+	q.distribution.Swap(i, j)
+	q.quantiles[i], q.quantiles[j] = q.quantiles[j], q.quantiles[i]
 }
 
 // buildDistribution consumes series from the beginning of the input slice that belong to a histogram
@@ -208,7 +320,7 @@ func (b *sampleBuilder) buildDistribution(
 		count, sum     float64
 		resetTimestamp int64
 		lastTimestamp  int64
-		dist           = distribution{bounds: make([]float64, 0, 20), values: make([]int64, 0, 20)}
+		dist           = distribution{bounds: make([]float64, 0, 20), values: make([]int64, 0, 20), exemplars: make([]*distribution_pb.Distribution_Exemplar, 0, 20)}
 		skip           = false
 	)
 	// We assume that all series belonging to the histogram are sequential. Consume series
@@ -239,7 +351,7 @@ Loop:
 		}
 		lastTimestamp = s.T
 
-		rt, v, ok := b.series.getResetAdjusted(s.Ref, s.T, s.V)
+		rt, v, ok := b.resetTimestampAdjusted(e, s.Ref, s.T, s.V)
 
 		switch name[len(baseName):] {
 		case metricSuffixSum:
@@ -257,6 +369,19 @@ Loop:
 			}
 			dist.bounds = append(dist.bounds, upper)
 			dist.values = append(dist.values, int64(v))
+			var ex *distribution_pb.Distribution_Exemplar
+			if b.sendExemplars {
+				if ed, ok := b.series.getExemplar(s.Ref); ok {
+					ex = buildExemplar(e.proto.Resource.GetLabels()["project_id"], ed)
+				}
+			}
+			dist.exemplars = append(dist.exemplars, ex)
+		case metricSuffixCreated:
+			// The _created series only supplies the reset timestamp resetTimestampAdjusted reads
+			// through getCreatedTimestamp; it isn't part of the distribution itself, but it shares baseName and labels with _sum/_count/
+			// the buckets, so it sorts into this sweep and must be skipped rather than ending it.
+			consumed++
+			continue
 		default:
 			break Loop
 		}
@@ -280,6 +405,7 @@ Loop:
 	var (
 		bounds           = dist.bounds[:0]
 		values           = dist.values[:0]
+		exemplars        []*distribution_pb.Distribution_Exemplar
 		mean, dev, lower float64
 		prevVal          int64
 	)
@@ -300,11 +426,129 @@ Loop:
 		lower = upper
 		prevVal = dist.values[i]
 		values = append(values, val)
+
+		if ex := dist.exemplars[i]; ex != nil {
+			exemplars = append(exemplars, ex)
+		}
 	}
 	d := &distribution_pb.Distribution{
 		Count:                 int64(count),
 		Mean:                  mean,
 		SumOfSquaredDeviation: dev,
+		BucketOptions:         detectBucketOptions(bounds),
+		BucketCounts:          values,
+		Exemplars:             exemplars,
+	}
+	return d, resetTimestamp, samples[consumed:], nil
+}
+
+// buildSummaryDistribution consumes series from the beginning of the input slice that belong to a
+// summary with the given metric name and label set, the same way buildDistribution does for
+// histograms, and folds its quantiles into a single Distribution. Since a summary only tells us the
+// value at each observed quantile rather than a bucket count, BucketCounts is reconstructed from the
+// gaps between consecutive quantiles: bucket i gets round(count * (q[i]-q[i-1])) observations, and
+// the final bucket takes whatever remainder is needed to make the counts sum to count exactly.
+func (b *sampleBuilder) buildSummaryDistribution(
+	ctx context.Context,
+	baseName string,
+	matchLset tsdbLabels.Labels,
+	samples []tsdb.RefSample,
+) (*distribution_pb.Distribution, int64, []tsdb.RefSample, error) {
+	var (
+		consumed       int
+		count, sum     float64
+		resetTimestamp int64
+		lastTimestamp  int64
+		dist           = distribution{bounds: make([]float64, 0, 10), values: make([]int64, 0, 10), exemplars: make([]*distribution_pb.Distribution_Exemplar, 0, 10)}
+		quantiles      = make([]float64, 0, 10)
+		skip           = false
+	)
+Loop:
+	for i, s := range samples {
+		e, ok, err := b.series.get(ctx, s.Ref)
+		if err != nil {
+			return nil, 0, samples, err
+		}
+		if !ok {
+			consumed++
+			continue
+		}
+		name := e.lset.Get("__name__")
+		if !strings.HasPrefix(name, baseName) || !summaryLabelsEqual(e.lset, matchLset) {
+			break
+		}
+		if i > 0 && s.T != lastTimestamp {
+			break
+		}
+		lastTimestamp = s.T
+
+		rt, v, ok := b.resetTimestampAdjusted(e, s.Ref, s.T, s.V)
+
+		switch name[len(baseName):] {
+		case metricSuffixSum:
+			sum = v
+		case metricSuffixCount:
+			count = v
+			// We take the count series as the authoritative source for the overall reset timestamp,
+			// exactly as buildDistribution does.
+			resetTimestamp = rt
+		case "": // Actual quantiles.
+			quantile, err := strconv.ParseFloat(e.lset.Get("quantile"), 64)
+			if err != nil || math.IsNaN(quantile) {
+				consumed++
+				continue
+			}
+			// dist.bounds holds the observed quantile value (what Stackdriver reports as the
+			// bucket boundary); the quantile fraction itself is tracked separately in quantiles,
+			// kept in lock-step through sorting, for the count-reconstruction math below.
+			dist.bounds = append(dist.bounds, s.V)
+			dist.values = append(dist.values, 0)
+			dist.exemplars = append(dist.exemplars, nil)
+			quantiles = append(quantiles, quantile)
+		case metricSuffixCreated:
+			// Shares baseName and labels with _sum/_count/the quantiles, same as in buildDistribution;
+			// skip it rather than ending the sweep.
+			consumed++
+			continue
+		default:
+			break Loop
+		}
+		if !ok {
+			skip = true
+		}
+		consumed++
+	}
+	if skip || resetTimestamp == 0 {
+		return nil, 0, samples[consumed:], nil
+	}
+	// Quantiles aren't guaranteed to arrive in order any more than histogram buckets are. Sort the
+	// observed values and quantiles together so they stay paired up.
+	sort.Sort(byQuantile{&dist, quantiles})
+
+	// ExplicitBuckets with N bounds implies N+1 total buckets (bucket 0 up to bounds[0], ..., the
+	// overflow bucket beyond bounds[N-1]), so values needs one more entry than bounds: the gap
+	// below each quantile, plus a trailing overflow entry for whatever's left above the highest
+	// quantile, so the total still sums to count.
+	bounds := make([]float64, len(dist.bounds))
+	values := make([]int64, len(dist.bounds)+1)
+	var assigned int64
+	for i, v := range dist.bounds {
+		bounds[i] = v
+		lowerQ := 0.0
+		if i > 0 {
+			lowerQ = quantiles[i-1]
+		}
+		values[i] = int64(math.Round(count * (quantiles[i] - lowerQ)))
+		assigned += values[i]
+	}
+	values[len(dist.bounds)] = int64(count) - assigned
+	var mean float64
+	if count > 0 {
+		mean = sum / count
+	}
+	d := &distribution_pb.Distribution{
+		Count: int64(count),
+		Mean:  mean,
 		BucketOptions: &distribution_pb.Distribution_BucketOptions{
 			Options: &distribution_pb.Distribution_BucketOptions_ExplicitBuckets{
 				ExplicitBuckets: &distribution_pb.Distribution_BucketOptions_Explicit{
@@ -317,6 +561,295 @@ Loop:
 	return d, resetTimestamp, samples[consumed:], nil
 }
 
+// summaryLabelsEqual checks whether two label sets for a summary series are equal aside from their
+// quantile and __name__ labels. It mirrors histogramLabelsEqual with "quantile" in place of "le".
+func summaryLabelsEqual(a, b tsdbLabels.Labels) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].Name == "quantile" || a[i].Name == "__name__" {
+			i++
+			continue
+		}
+		if b[j].Name == "quantile" || b[j].Name == "__name__" {
+			j++
+			continue
+		}
+		if a[i] != b[j] {
+			return false
+		}
+		i++
+		j++
+	}
+	for i < len(a) {
+		if a[i].Name == "quantile" || a[i].Name == "__name__" {
+			i++
+			continue
+		}
+		break
+	}
+	for j < len(b) {
+		if b[j].Name == "quantile" || b[j].Name == "__name__" {
+			j++
+			continue
+		}
+		break
+	}
+	return i == len(a) && j == len(b)
+}
+
+// bucketOptionTolerance bounds how far a bucket's observed spacing may drift, relative to the
+// spacing implied by its neighbours, before we give up on representing it as exponential or linear
+// and fall back to shipping the bounds explicitly.
+const bucketOptionTolerance = 1e-9
+
+// detectBucketOptions picks the cheapest Stackdriver bucket representation for a sorted list of
+// finite bucket upper bounds. Explicit buckets cost one point per bucket, so histograms produced by
+// Prometheus's own prometheus.ExponentialBuckets/prometheus.LinearBuckets helpers are detected and
+// re-expressed as Exponential or Linear instead. Anything that doesn't fit either pattern, e.g. a
+// hand-curated set of bounds or the client library's default buckets (whose ratios mix 2 and 2.5),
+// falls back to ExplicitBuckets exactly as before.
+func detectBucketOptions(bounds []float64) *distribution_pb.Distribution_BucketOptions {
+	if opts, ok := exponentialBucketOptions(bounds); ok {
+		return opts
+	}
+	if opts, ok := linearBucketOptions(bounds); ok {
+		return opts
+	}
+	return &distribution_pb.Distribution_BucketOptions{
+		Options: &distribution_pb.Distribution_BucketOptions_ExplicitBuckets{
+			ExplicitBuckets: &distribution_pb.Distribution_BucketOptions_Explicit{
+				Bounds: bounds,
+			},
+		},
+	}
+}
+
+// exponentialBucketOptions reports whether bounds[i] = Scale*growth^i within
+// bucketOptionTolerance, which is exactly the shape prometheus.ExponentialBuckets produces. bounds holds the len(bounds) threshold points between
+// buckets, not bucket counts, so per the Distribution.BucketOptions.Exponential contract (boundary
+// before the first finite bucket is Scale, boundary after finite bucket i is Scale*growth^(i+1))
+// NumFiniteBuckets is len(bounds)-1, one less than the number of thresholds, and Scale is bounds[0]
+// itself rather than a growth-step below it.
+func exponentialBucketOptions(bounds []float64) (*distribution_pb.Distribution_BucketOptions, bool) {
+	if len(bounds) < 2 || bounds[0] <= 0 {
+		return nil, false
+	}
+	growth := bounds[1] / bounds[0]
+	if growth <= 1 {
+		return nil, false
+	}
+	logGrowth := math.Log(growth)
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i-1] <= 0 {
+			return nil, false
+		}
+		if d := math.Log(bounds[i]/bounds[i-1]) - logGrowth; math.Abs(d) > bucketOptionTolerance {
+			return nil, false
+		}
+	}
+	return &distribution_pb.Distribution_BucketOptions{
+		Options: &distribution_pb.Distribution_BucketOptions_ExponentialBuckets{
+			ExponentialBuckets: &distribution_pb.Distribution_BucketOptions_Exponential{
+				NumFiniteBuckets: int32(len(bounds)) - 1,
+				GrowthFactor:     growth,
+				Scale:            bounds[0],
+			},
+		},
+	}, true
+}
+
+// linearBucketOptions reports whether bounds are equally spaced, which is the shape
+// prometheus.LinearBuckets produces. As in exponentialBucketOptions, bounds holds len(bounds)
+// threshold points, so NumFiniteBuckets is len(bounds)-1 and Offset is bounds[0] itself: the
+// Distribution.BucketOptions.Linear contract puts the boundary before the first finite bucket at
+// Offset, and the boundary after finite bucket i at Offset+(i+1)*Width.
+func linearBucketOptions(bounds []float64) (*distribution_pb.Distribution_BucketOptions, bool) {
+	if len(bounds) < 2 {
+		return nil, false
+	}
+	width := bounds[1] - bounds[0]
+	if width <= 0 {
+		return nil, false
+	}
+	for i := 1; i < len(bounds); i++ {
+		if d := (bounds[i] - bounds[i-1]) - width; math.Abs(d) > bucketOptionTolerance*width {
+			return nil, false
+		}
+	}
+	return &distribution_pb.Distribution_BucketOptions{
+		Options: &distribution_pb.Distribution_BucketOptions_LinearBuckets{
+			LinearBuckets: &distribution_pb.Distribution_BucketOptions_Linear{
+				NumFiniteBuckets: int32(len(bounds)) - 1,
+				Width:            width,
+				Offset:           bounds[0],
+			},
+		},
+	}, true
+}
+
+// buildNativeDistribution turns a Prometheus native (sparse) histogram sample into a Stackdriver
+// distribution. Unlike buildDistribution, there are no sibling le/_sum/_count series to sweep up:
+// the full bucket layout is carried on the sample itself, as looked up through entry.nativeHistogram.
+// It returns false if the sample's histogram hasn't been populated yet, e.g. because it raced the WAL.
+func (b *sampleBuilder) buildNativeDistribution(entry *seriesCacheEntry, sample tsdb.RefSample) (*distribution_pb.Distribution, int64, bool) {
+	h, ok := b.series.getHistogram(sample.Ref, sample.T)
+	if !ok {
+		return nil, 0, false
+	}
+	resetTimestamp, ok := b.nativeHistogramResetTimestamp(entry, sample, h)
+	if !ok {
+		return nil, 0, false
+	}
+
+	bucketOptions, bounds, counts := nativeHistogramBuckets(h, entry.zeroThreshold)
+	var mean, dev float64
+	if h.Count > 0 {
+		mean = h.Sum / float64(h.Count)
+	}
+	lower := 0.0
+	for i, upper := range bounds {
+		x := (lower + upper) / 2
+		dev += float64(counts[i]) * (x - mean) * (x - mean)
+		lower = upper
+	}
+	return &distribution_pb.Distribution{
+		Count:                 int64(h.Count),
+		Mean:                  mean,
+		SumOfSquaredDeviation: dev,
+		BucketOptions:         bucketOptions,
+		BucketCounts:          counts,
+	}, resetTimestamp, true
+}
+
+// nativeHistogramResetTimestamp derives the Stackdriver start time for a native histogram sample.
+// Native histograms carry their own reset hint rather than relying on value-drop detection, so we
+// only fall back to the float heuristic on the total count when the hint itself is inconclusive.
+func (b *sampleBuilder) nativeHistogramResetTimestamp(entry *seriesCacheEntry, sample tsdb.RefSample, h *histogram.Histogram) (int64, bool) {
+	switch h.CounterResetHint {
+	case histogram.CounterReset:
+		b.series.setResetTimestamp(entry.hash, sample.T)
+		return sample.T, true
+	case histogram.NotCounterReset, histogram.GaugeType:
+		return b.series.resetTimestamp(entry.hash), true
+	default: // histogram.UnknownCounterReset
+		rt, _, ok := b.series.getResetAdjusted(sample.Ref, sample.T, float64(h.Count))
+		return rt, ok
+	}
+}
+
+// nativeHistogramBuckets expands a native histogram's exponential spans into Stackdriver bucket
+// options. bounds[0] is always the synthetic zero+negative fold-in bucket expandNativeHistogramSpans
+// adds, which sits at zeroThreshold rather than at a point on the positive span's geometric
+// sequence, so we can't just assert Exponential from the schema: we reuse the same validating
+// check exponentialBucketOptions runs for classic histograms against the fully-expanded bounds,
+// and fall back to ExplicitBuckets whenever it doesn't hold. The synthetic bucket usually breaks
+// the ratio check against bounds[1], so most samples come out Explicit; a sample whose expanded
+// bounds do fit, such as a single positive bucket leaving just two bounds, comes out Exponential.
+func nativeHistogramBuckets(h *histogram.Histogram, zeroThreshold float64) (*distribution_pb.Distribution_BucketOptions, []float64, []int64) {
+	bounds, counts := expandNativeHistogramSpans(h, zeroThreshold)
+	if h.Schema >= 0 && !sparseNativeHistogram(h) {
+		if opts, ok := exponentialBucketOptions(bounds); ok {
+			return opts, bounds, counts
+		}
+	}
+	return &distribution_pb.Distribution_BucketOptions{
+		Options: &distribution_pb.Distribution_BucketOptions_ExplicitBuckets{
+			ExplicitBuckets: &distribution_pb.Distribution_BucketOptions_Explicit{
+				Bounds: bounds,
+			},
+		},
+	}, bounds, counts
+}
+
+// sparseNativeHistogram reports whether a histogram's spans are sparse enough, relative to the
+// number of buckets they'd expand to, that an exponential approximation would waste more points on
+// empty buckets than it saves over an explicit list.
+func sparseNativeHistogram(h *histogram.Histogram) bool {
+	var spanned, populated int
+	for _, s := range h.PositiveSpans {
+		spanned += int(s.Length) + int(s.Offset)
+		populated += int(s.Length)
+	}
+	for _, s := range h.NegativeSpans {
+		spanned += int(s.Length) + int(s.Offset)
+		populated += int(s.Length)
+	}
+	return spanned > 0 && populated*4 < spanned
+}
+
+// expandNativeHistogramSpans walks a native histogram's positive spans and deltas into ascending
+// bucket upper bounds and absolute counts, mirroring the midpoint convention buildDistribution uses
+// for classic histograms. The zero bucket and the entire negative range are folded into a single
+// leading bucket bounded by zeroThreshold, since Stackdriver distributions have no concept of a
+// signed domain. As with buildDistribution's bounds/values, counts ends up one longer than bounds:
+// native histograms enumerate every populated bucket, so nothing falls beyond the last expanded
+// span, and the trailing zero is the overflow bucket Explicit/Exponential/Linear all require.
+func expandNativeHistogramSpans(h *histogram.Histogram, zeroThreshold float64) ([]float64, []int64) {
+	var negative, negDelta int64
+	negIdx := 0
+	for _, span := range h.NegativeSpans {
+		for i := 0; i < int(span.Length); i++ {
+			negDelta += h.NegativeBuckets[negIdx]
+			negative += negDelta
+			negIdx++
+		}
+	}
+
+	bounds := make([]float64, 0, len(h.PositiveBuckets)+1)
+	counts := make([]int64, 0, len(h.PositiveBuckets)+1)
+	bounds = append(bounds, zeroThreshold)
+	counts = append(counts, negative+int64(h.ZeroCount))
+
+	base := math.Exp2(math.Exp2(-float64(h.Schema)))
+	bucketIndex := 0
+	var delta int64
+	posIdx := 0
+	for _, span := range h.PositiveSpans {
+		bucketIndex += int(span.Offset)
+		for i := 0; i < int(span.Length); i++ {
+			delta += h.PositiveBuckets[posIdx]
+			bounds = append(bounds, math.Pow(base, float64(bucketIndex+1)))
+			counts = append(counts, delta)
+			bucketIndex++
+			posIdx++
+		}
+	}
+	// Trailing overflow bucket: native histograms enumerate every populated bucket up to
+	// bounds[len(bounds)-1], so there is never anything beyond it.
+	counts = append(counts, 0)
+	return bounds, counts
+}
+
+// exemplarData is the most recent exemplar seriesGetter has buffered for a series since the last
+// flush: a value, a millisecond timestamp, and whatever trace/span labels Prometheus attached to it.
+type exemplarData struct {
+	value   float64
+	ts      int64
+	traceID string
+	spanID  string
+}
+
+// buildExemplar converts a buffered Prometheus exemplar into a Stackdriver distribution exemplar.
+// When the exemplar carries a trace_id label, it's packed into a SpanContext attachment so Cloud
+// Monitoring can link the point back to the trace it was sampled from.
+func buildExemplar(projectID string, ed exemplarData) *distribution_pb.Distribution_Exemplar {
+	ex := &distribution_pb.Distribution_Exemplar{
+		Value:     ed.value,
+		Timestamp: getTimestamp(ed.ts),
+	}
+	if ed.traceID == "" {
+		return ex
+	}
+	sc, err := proto.Marshal(&monitoring_pb.SpanContext{
+		SpanName: fmt.Sprintf("projects/%s/traces/%s/spans/%s", projectID, ed.traceID, ed.spanID),
+	})
+	if err != nil {
+		return ex
+	}
+	ex.Attachments = []*any_pb.Any{{TypeUrl: spanContextTypeURL, Value: sc}}
+	return ex
+}
+
 // histogramLabelsEqual checks whether two label sets for a histogram series are equal aside from their
 // le and __name__ labels.
 func histogramLabelsEqual(a, b tsdbLabels.Labels) bool {
@@ -0,0 +1,555 @@
+/*
+Copyright 2018 Google Inc.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retrieval
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+	"github.com/prometheus/tsdb"
+	tsdbLabels "github.com/prometheus/tsdb/labels"
+	distribution_pb "google.golang.org/genproto/googleapis/api/distribution"
+)
+
+// exponentialBuckets mirrors prometheus.ExponentialBuckets(start, factor, count).
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// linearBuckets mirrors prometheus.LinearBuckets(start, width, count).
+func linearBuckets(start, width float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start += width
+	}
+	return bounds
+}
+
+// reconstructExponentialBounds rebuilds the len(bounds) threshold points Stackdriver would derive
+// from an Exponential BucketOptions: the boundary before the first finite bucket is Scale, and the
+// boundary after finite bucket i is Scale*growth^(i+1).
+func reconstructExponentialBounds(exp *distribution_pb.Distribution_BucketOptions_Exponential) []float64 {
+	bounds := make([]float64, exp.NumFiniteBuckets+1)
+	for i := range bounds {
+		bounds[i] = exp.Scale * math.Pow(exp.GrowthFactor, float64(i))
+	}
+	return bounds
+}
+
+// reconstructLinearBounds is the Linear sibling of reconstructExponentialBounds: the boundary
+// before the first finite bucket is Offset, and the boundary after finite bucket i is
+// Offset+(i+1)*Width.
+func reconstructLinearBounds(lin *distribution_pb.Distribution_BucketOptions_Linear) []float64 {
+	bounds := make([]float64, lin.NumFiniteBuckets+1)
+	for i := range bounds {
+		bounds[i] = lin.Offset + float64(i)*lin.Width
+	}
+	return bounds
+}
+
+func assertBoundsEqual(t *testing.T, got, want []float64) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("len(bounds) = %d, want %d (%v vs %v)", len(got), len(want), got, want)
+	}
+	for i := range want {
+		if math.Abs(got[i]-want[i]) > 1e-6*want[i] {
+			t.Errorf("bounds[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestDetectBucketOptions(t *testing.T) {
+	cases := []struct {
+		name   string
+		bounds []float64
+		want   string
+	}{
+		{
+			// client_golang's DefBuckets: {.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}.
+			// The ratio between consecutive bounds alternates between 2 and 2.5, so this is
+			// neither exponential nor linear and must stay explicit.
+			name:   "prometheus default buckets",
+			bounds: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+			want:   "explicit",
+		},
+		{
+			name:   "exponential buckets",
+			bounds: exponentialBuckets(0.005, 2, 20),
+			want:   "exponential",
+		},
+		{
+			name:   "linear buckets",
+			bounds: linearBuckets(0, 5, 10),
+			want:   "linear",
+		},
+		{
+			name:   "irregular bounds",
+			bounds: []float64{1, 2, 5, 9, 100},
+			want:   "explicit",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := detectBucketOptions(c.bounds)
+			switch c.want {
+			case "exponential":
+				exp, ok := opts.Options.(*distribution_pb.Distribution_BucketOptions_ExponentialBuckets)
+				if !ok {
+					t.Fatalf("got %T, want ExponentialBuckets", opts.Options)
+				}
+				// len(bounds) threshold points split into NumFiniteBuckets+2 total buckets
+				// (underflow, the finite buckets between thresholds, overflow), so
+				// NumFiniteBuckets is one less than the number of thresholds.
+				if got := int(exp.ExponentialBuckets.NumFiniteBuckets); got != len(c.bounds)-1 {
+					t.Errorf("NumFiniteBuckets = %d, want %d", got, len(c.bounds)-1)
+				}
+				reconstructed := reconstructExponentialBounds(exp.ExponentialBuckets)
+				assertBoundsEqual(t, reconstructed, c.bounds)
+			case "linear":
+				lin, ok := opts.Options.(*distribution_pb.Distribution_BucketOptions_LinearBuckets)
+				if !ok {
+					t.Fatalf("got %T, want LinearBuckets", opts.Options)
+				}
+				if got := int(lin.LinearBuckets.NumFiniteBuckets); got != len(c.bounds)-1 {
+					t.Errorf("NumFiniteBuckets = %d, want %d", got, len(c.bounds)-1)
+				}
+				reconstructed := reconstructLinearBounds(lin.LinearBuckets)
+				assertBoundsEqual(t, reconstructed, c.bounds)
+			case "explicit":
+				exp, ok := opts.Options.(*distribution_pb.Distribution_BucketOptions_ExplicitBuckets)
+				if !ok {
+					t.Fatalf("got %T, want ExplicitBuckets", opts.Options)
+				}
+				if len(exp.ExplicitBuckets.Bounds) != len(c.bounds) {
+					t.Errorf("len(Bounds) = %d, want %d", len(exp.ExplicitBuckets.Bounds), len(c.bounds))
+				}
+			}
+		})
+	}
+}
+
+// TestBuildDistributionExponentialBucketCardinality round-trips prometheus.ExponentialBuckets
+// through the full buildDistribution sweep, not just detectBucketOptions in isolation: it checks
+// that the emitted BucketOptions' reconstructed thresholds match the actual `le` values scraped,
+// and that BucketCounts (which buildDistribution sizes independently of detectBucketOptions) has
+// exactly NumFiniteBuckets+2 entries, matching the Exponential cardinality contract.
+func TestBuildDistributionExponentialBucketCardinality(t *testing.T) {
+	const base = "http_request_duration_seconds"
+	bounds := exponentialBuckets(0.005, 2, 20)
+
+	entries := map[uint64]*seriesCacheEntry{}
+	samples := make([]tsdb.RefSample, 0, len(bounds)+3)
+	var ref uint64
+	newRef := func() uint64 {
+		ref++
+		return ref
+	}
+	for i, le := range bounds {
+		r := newRef()
+		entries[r] = &seriesCacheEntry{lset: lsetWithName(base+"_bucket", tsdbLabels.Label{Name: "le", Value: strconv.FormatFloat(le, 'g', -1, 64)})}
+		samples = append(samples, tsdb.RefSample{Ref: r, T: 1000, V: float64(i + 1)})
+	}
+	infRef := newRef()
+	entries[infRef] = &seriesCacheEntry{lset: lsetWithName(base+"_bucket", tsdbLabels.Label{Name: "le", Value: "+Inf"})}
+	samples = append(samples, tsdb.RefSample{Ref: infRef, T: 1000, V: float64(len(bounds) + 1)})
+
+	countRef := newRef()
+	entries[countRef] = &seriesCacheEntry{lset: lsetWithName(base + "_count")}
+	samples = append(samples, tsdb.RefSample{Ref: countRef, T: 1000, V: float64(len(bounds) + 1)})
+
+	sumRef := newRef()
+	entries[sumRef] = &seriesCacheEntry{lset: lsetWithName(base + "_sum")}
+	samples = append(samples, tsdb.RefSample{Ref: sumRef, T: 1000, V: 100})
+
+	getter := &sweepSeriesGetter{entries: entries}
+	b := newSampleBuilder(getter, false, false, false)
+	d, _, rest, err := b.buildDistribution(context.Background(), base, tsdbLabels.Labels{{Name: "__name__", Value: base}}, samples)
+	if err != nil {
+		t.Fatalf("buildDistribution: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("len(rest) = %d, want 0", len(rest))
+	}
+	exp, ok := d.BucketOptions.Options.(*distribution_pb.Distribution_BucketOptions_ExponentialBuckets)
+	if !ok {
+		t.Fatalf("got %T, want ExponentialBuckets", d.BucketOptions.Options)
+	}
+	assertBoundsEqual(t, reconstructExponentialBounds(exp.ExponentialBuckets), bounds)
+	if want := int(exp.ExponentialBuckets.NumFiniteBuckets) + 2; len(d.BucketCounts) != want {
+		t.Errorf("len(BucketCounts) = %d, want %d (NumFiniteBuckets+2)", len(d.BucketCounts), want)
+	}
+}
+
+func TestExpandNativeHistogramSpans(t *testing.T) {
+	// Schema 0 gives a growth factor of 2, so bucketIndex i has upper bound 2^(i+1).
+	h := &histogram.Histogram{
+		Schema:    0,
+		Count:     19,
+		ZeroCount: 3,
+		PositiveSpans: []histogram.Span{
+			{Offset: 1, Length: 2}, // bucket indexes 1, 2
+		},
+		PositiveBuckets: []int64{5, 2}, // absolute counts 5, 7
+		NegativeSpans: []histogram.Span{
+			{Offset: 0, Length: 1}, // bucket index 0
+		},
+		NegativeBuckets: []int64{4}, // absolute count 4
+	}
+	zeroThreshold := 0.001
+
+	bounds, counts := expandNativeHistogramSpans(h, zeroThreshold)
+
+	wantBounds := []float64{0.001, 4, 8}
+	if len(bounds) != len(wantBounds) {
+		t.Fatalf("len(bounds) = %d, want %d (%v)", len(bounds), len(wantBounds), bounds)
+	}
+	for i, b := range wantBounds {
+		if bounds[i] != b {
+			t.Errorf("bounds[%d] = %v, want %v", i, bounds[i], b)
+		}
+	}
+	// The leading bucket folds ZeroCount (3) and the negative side's total (4) together. counts has
+	// one more entry than bounds: a trailing zero for the overflow bucket beyond the last span,
+	// matching the Explicit/Exponential/Linear bucket-count contract buildDistribution also follows.
+	wantCounts := []int64{7, 5, 7, 0}
+	if len(counts) != len(wantCounts) {
+		t.Fatalf("len(counts) = %d, want %d (%v)", len(counts), len(wantCounts), counts)
+	}
+	for i, c := range wantCounts {
+		if counts[i] != c {
+			t.Errorf("counts[%d] = %v, want %v", i, counts[i], c)
+		}
+	}
+
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	if total != int64(h.Count) {
+		t.Errorf("sum(counts) = %d, want h.Count = %d", total, h.Count)
+	}
+}
+
+// TestNativeHistogramBucketsFallsBackToExplicit exercises the common case of a contiguous run of
+// positive buckets starting at offset 0: the synthetic zero/negative bucket expandNativeHistogramSpans
+// prepends sits at zeroThreshold, not on the positive span's geometric sequence, so the result must
+// not be claimed as Exponential (which would make Stackdriver reconstruct completely wrong bounds)
+// and must fall back to the actual observed bounds instead.
+func TestNativeHistogramBucketsFallsBackToExplicit(t *testing.T) {
+	h := &histogram.Histogram{
+		Schema: 0,
+		PositiveSpans: []histogram.Span{
+			{Offset: 0, Length: 5},
+		},
+		PositiveBuckets: []int64{1, 0, 0, 0, 0},
+	}
+	zeroThreshold := 0.001
+	opts, bounds, counts := nativeHistogramBuckets(h, zeroThreshold)
+	exp, ok := opts.Options.(*distribution_pb.Distribution_BucketOptions_ExplicitBuckets)
+	if !ok {
+		t.Fatalf("got %T, want ExplicitBuckets", opts.Options)
+	}
+	wantBounds := []float64{0.001, 2, 4, 8, 16, 32}
+	if len(exp.ExplicitBuckets.Bounds) != len(wantBounds) {
+		t.Fatalf("len(Bounds) = %d, want %d (%v)", len(exp.ExplicitBuckets.Bounds), len(wantBounds), exp.ExplicitBuckets.Bounds)
+	}
+	// Explicit with N bounds implies N+1 total buckets; counts must match.
+	if len(counts) != len(wantBounds)+1 {
+		t.Errorf("len(counts) = %d, want %d (len(Bounds)+1)", len(counts), len(wantBounds)+1)
+	}
+	for i, b := range wantBounds {
+		if exp.ExplicitBuckets.Bounds[i] != b {
+			t.Errorf("Bounds[%d] = %v, want %v", i, exp.ExplicitBuckets.Bounds[i], b)
+		}
+		if bounds[i] != b {
+			t.Errorf("bounds[%d] = %v, want %v", i, bounds[i], b)
+		}
+	}
+}
+
+// TestNativeHistogramBucketsExponentialReconstructs covers the degenerate case where there are too
+// few buckets for the synthetic zero bucket to break the ratio check (Stackdriver's Exponential
+// formula bounds[i] = Scale*growth^i is always satisfiable by exactly two points): whatever gets
+// returned, reconstructing from it must reproduce the actual observed bounds, and BucketCounts
+// (one longer than bounds) must match NumFiniteBuckets+2.
+func TestNativeHistogramBucketsExponentialReconstructs(t *testing.T) {
+	h := &histogram.Histogram{
+		Schema: 0,
+		PositiveSpans: []histogram.Span{
+			{Offset: 3, Length: 1},
+		},
+		PositiveBuckets: []int64{1},
+	}
+	zeroThreshold := 0.001
+	opts, bounds, counts := nativeHistogramBuckets(h, zeroThreshold)
+	exp, ok := opts.Options.(*distribution_pb.Distribution_BucketOptions_ExponentialBuckets)
+	if !ok {
+		t.Fatalf("got %T, want ExponentialBuckets", opts.Options)
+	}
+	growth := exp.ExponentialBuckets.GrowthFactor
+	scale := exp.ExponentialBuckets.Scale
+	for i, b := range bounds {
+		if got := scale * math.Pow(growth, float64(i)); math.Abs(got-b) > 1e-9 {
+			t.Errorf("reconstructed bound %d = %v, want %v", i, got, b)
+		}
+	}
+	if want := int(exp.ExponentialBuckets.NumFiniteBuckets) + 2; len(counts) != want {
+		t.Errorf("len(counts) = %d, want %d (NumFiniteBuckets+2)", len(counts), want)
+	}
+}
+
+// fakeSeriesGetter is a minimal seriesGetter stub for exercising resetTimestampAdjusted.
+type fakeSeriesGetter struct {
+	seriesGetter
+	createdTimestamp float64
+	hasCreated       bool
+	resetTimestamp   int64
+	resetValue       float64
+}
+
+func (f *fakeSeriesGetter) getCreatedTimestamp(metric string, lset tsdbLabels.Labels) (float64, bool) {
+	return f.createdTimestamp, f.hasCreated
+}
+
+func (f *fakeSeriesGetter) getResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool) {
+	return f.resetTimestamp, f.resetValue, true
+}
+
+func TestResetTimestampAdjustedPrefersCreatedTimestamp(t *testing.T) {
+	entry := &seriesCacheEntry{lset: tsdbLabels.Labels{{Name: "__name__", Value: "http_requests_total"}}}
+
+	t.Run("created timestamp wins when present and not newer than the sample", func(t *testing.T) {
+		b := &sampleBuilder{
+			useCreatedTimestamps: true,
+			series:               &fakeSeriesGetter{createdTimestamp: 1000, hasCreated: true, resetTimestamp: 500000, resetValue: 41},
+		}
+		rt, v, ok := b.resetTimestampAdjusted(entry, 1, 1000000, 42)
+		if !ok || rt != 1000*1000 || v != 42 {
+			t.Errorf("got (%d, %v, %v), want (%d, 42, true)", rt, v, ok, 1000*1000)
+		}
+	})
+
+	t.Run("falls back to getResetAdjusted when no created timestamp is cached", func(t *testing.T) {
+		b := &sampleBuilder{
+			useCreatedTimestamps: true,
+			series:               &fakeSeriesGetter{hasCreated: false, resetTimestamp: 500000, resetValue: 41},
+		}
+		rt, v, ok := b.resetTimestampAdjusted(entry, 1, 1000000, 42)
+		if !ok || rt != 500000 || v != 41 {
+			t.Errorf("got (%d, %v, %v), want (500000, 41, true)", rt, v, ok)
+		}
+	})
+
+	t.Run("falls back when the created timestamp is newer than the sample", func(t *testing.T) {
+		b := &sampleBuilder{
+			useCreatedTimestamps: true,
+			series:               &fakeSeriesGetter{createdTimestamp: 2000, hasCreated: true, resetTimestamp: 500000, resetValue: 41},
+		}
+		rt, v, ok := b.resetTimestampAdjusted(entry, 1, 1000000, 42)
+		if !ok || rt != 500000 || v != 41 {
+			t.Errorf("got (%d, %v, %v), want (500000, 41, true)", rt, v, ok)
+		}
+	})
+
+	t.Run("ignored entirely when useCreatedTimestamps is off", func(t *testing.T) {
+		b := &sampleBuilder{
+			useCreatedTimestamps: false,
+			series:               &fakeSeriesGetter{createdTimestamp: 1000, hasCreated: true, resetTimestamp: 500000, resetValue: 41},
+		}
+		rt, v, ok := b.resetTimestampAdjusted(entry, 1, 1000000, 42)
+		if !ok || rt != 500000 || v != 41 {
+			t.Errorf("got (%d, %v, %v), want (500000, 41, true)", rt, v, ok)
+		}
+	})
+}
+
+// sweepSeriesGetter is a seriesGetter stub backing a fixed table of series, for exercising the
+// buildDistribution/buildSummaryDistribution sweep over a batch of samples.
+type sweepSeriesGetter struct {
+	seriesGetter
+	entries map[uint64]*seriesCacheEntry
+}
+
+func (g *sweepSeriesGetter) get(ctx context.Context, ref uint64) (*seriesCacheEntry, bool, error) {
+	e, ok := g.entries[ref]
+	return e, ok, nil
+}
+
+func (g *sweepSeriesGetter) getResetAdjusted(ref uint64, t int64, v float64) (int64, float64, bool) {
+	return t, v, true
+}
+
+func (g *sweepSeriesGetter) getExemplar(ref uint64) (exemplarData, bool) {
+	return exemplarData{}, false
+}
+
+func lsetWithName(name string, extra ...tsdbLabels.Label) tsdbLabels.Labels {
+	lset := append(tsdbLabels.Labels{{Name: "__name__", Value: name}}, extra...)
+	sort.Sort(lset)
+	return lset
+}
+
+// TestBuildDistributionSkipsCreatedSeries covers the sweep's handling of a histogram's _created
+// series: it shares http_request_duration_seconds' base name and carries no le label, so it sorts
+// into the same sweep as _sum/_count/the buckets. Since it alphabetically sorts between _count and
+// _sum, it must not end the sweep before _sum is consumed.
+func TestBuildDistributionSkipsCreatedSeries(t *testing.T) {
+	const base = "http_request_duration_seconds"
+	getter := &sweepSeriesGetter{entries: map[uint64]*seriesCacheEntry{
+		1: {lset: lsetWithName(base+"_bucket", tsdbLabels.Label{Name: "le", Value: "1"})},
+		2: {lset: lsetWithName(base+"_bucket", tsdbLabels.Label{Name: "le", Value: "+Inf"})},
+		3: {lset: lsetWithName(base + "_count")},
+		4: {lset: lsetWithName(base + "_created")},
+		5: {lset: lsetWithName(base + "_sum")},
+	}}
+	b := newSampleBuilder(getter, false, false, false)
+	samples := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 2},
+		{Ref: 2, T: 1000, V: 5},
+		{Ref: 3, T: 1000, V: 5},
+		{Ref: 4, T: 1000, V: 1234.5},
+		{Ref: 5, T: 1000, V: 12.5},
+	}
+	d, resetTimestamp, rest, err := b.buildDistribution(context.Background(), base, tsdbLabels.Labels{{Name: "__name__", Value: base}}, samples)
+	if err != nil {
+		t.Fatalf("buildDistribution: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("len(rest) = %d, want 0 (all 5 samples consumed)", len(rest))
+	}
+	if resetTimestamp == 0 {
+		t.Fatalf("resetTimestamp = 0, want the _count series' reset timestamp")
+	}
+	if d.Mean != 12.5/5 {
+		t.Errorf("Mean = %v, want %v (sum/count); _created truncating the sweep would leave sum at 0", d.Mean, 12.5/5)
+	}
+	if d.Count != 5 {
+		t.Errorf("Count = %v, want 5", d.Count)
+	}
+}
+
+// TestBuildSummaryDistributionBucketCardinality checks buildSummaryDistribution's actual bucket
+// reconstruction end to end: ExplicitBuckets with N observed quantile values implies N+1 total
+// buckets, so BucketCounts must have one more entry than Bounds, and those counts must still sum to
+// the summary's total count.
+func TestBuildSummaryDistributionBucketCardinality(t *testing.T) {
+	const base = "rpc_duration_seconds"
+	getter := &sweepSeriesGetter{entries: map[uint64]*seriesCacheEntry{
+		1: {lset: lsetWithName(base, tsdbLabels.Label{Name: "quantile", Value: "0.5"})},
+		2: {lset: lsetWithName(base, tsdbLabels.Label{Name: "quantile", Value: "0.9"})},
+		3: {lset: lsetWithName(base, tsdbLabels.Label{Name: "quantile", Value: "0.99"})},
+		4: {lset: lsetWithName(base + "_count")},
+		5: {lset: lsetWithName(base + "_sum")},
+	}}
+	b := newSampleBuilder(getter, false, false, false)
+	samples := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 0.2},
+		{Ref: 2, T: 1000, V: 0.5},
+		{Ref: 3, T: 1000, V: 0.9},
+		{Ref: 4, T: 1000, V: 100},
+		{Ref: 5, T: 1000, V: 42},
+	}
+	d, _, rest, err := b.buildSummaryDistribution(context.Background(), base, tsdbLabels.Labels{{Name: "__name__", Value: base}}, samples)
+	if err != nil {
+		t.Fatalf("buildSummaryDistribution: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("len(rest) = %d, want 0", len(rest))
+	}
+	exp, ok := d.BucketOptions.Options.(*distribution_pb.Distribution_BucketOptions_ExplicitBuckets)
+	if !ok {
+		t.Fatalf("got %T, want ExplicitBuckets", d.BucketOptions.Options)
+	}
+	bounds := exp.ExplicitBuckets.Bounds
+	assertBoundsEqual(t, bounds, []float64{0.2, 0.5, 0.9})
+	if len(d.BucketCounts) != len(bounds)+1 {
+		t.Fatalf("len(BucketCounts) = %d, want %d (len(Bounds)+1)", len(d.BucketCounts), len(bounds)+1)
+	}
+	wantCounts := []int64{50, 40, 9, 1} // round(100*.5), round(100*.4), round(100*.09), remainder
+	for i, c := range wantCounts {
+		if d.BucketCounts[i] != c {
+			t.Errorf("BucketCounts[%d] = %d, want %d", i, d.BucketCounts[i], c)
+		}
+	}
+	var total int64
+	for _, c := range d.BucketCounts {
+		total += c
+	}
+	if total != d.Count {
+		t.Errorf("sum(BucketCounts) = %d, want Count = %d", total, d.Count)
+	}
+}
+
+// TestBuildSummaryDistributionSkipsCreatedSeries is the buildSummaryDistribution sibling of
+// TestBuildDistributionSkipsCreatedSeries: a summary's _created series sorts alphabetically between
+// _count and _sum too, and must not truncate the sweep before _sum is consumed.
+func TestBuildSummaryDistributionSkipsCreatedSeries(t *testing.T) {
+	const base = "rpc_duration_seconds"
+	getter := &sweepSeriesGetter{entries: map[uint64]*seriesCacheEntry{
+		1: {lset: lsetWithName(base, tsdbLabels.Label{Name: "quantile", Value: "0.5"})},
+		2: {lset: lsetWithName(base + "_count")},
+		3: {lset: lsetWithName(base + "_created")},
+		4: {lset: lsetWithName(base + "_sum")},
+	}}
+	b := newSampleBuilder(getter, false, false, false)
+	samples := []tsdb.RefSample{
+		{Ref: 1, T: 1000, V: 0.2},
+		{Ref: 2, T: 1000, V: 5},
+		{Ref: 3, T: 1000, V: 1234.5},
+		{Ref: 4, T: 1000, V: 10},
+	}
+	d, resetTimestamp, rest, err := b.buildSummaryDistribution(context.Background(), base, tsdbLabels.Labels{{Name: "__name__", Value: base}}, samples)
+	if err != nil {
+		t.Fatalf("buildSummaryDistribution: %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("len(rest) = %d, want 0 (all 4 samples consumed)", len(rest))
+	}
+	if resetTimestamp == 0 {
+		t.Fatalf("resetTimestamp = 0, want the _count series' reset timestamp")
+	}
+	if d.Mean != 10.0/5 {
+		t.Errorf("Mean = %v, want %v (sum/count); _created truncating the sweep would leave sum at 0", d.Mean, 10.0/5)
+	}
+}
+
+func TestBuildExemplar(t *testing.T) {
+	t.Run("without a trace_id, ships a bare value/timestamp", func(t *testing.T) {
+		ex := buildExemplar("my-project", exemplarData{value: 1.5, ts: 1000})
+		if ex.Value != 1.5 || ex.Attachments != nil {
+			t.Errorf("got %+v, want Value=1.5 and no attachments", ex)
+		}
+	})
+
+	t.Run("with a trace_id, packs a SpanContext attachment", func(t *testing.T) {
+		ex := buildExemplar("my-project", exemplarData{value: 1.5, ts: 1000, traceID: "abc", spanID: "def"})
+		if len(ex.Attachments) != 1 {
+			t.Fatalf("len(Attachments) = %d, want 1", len(ex.Attachments))
+		}
+		if ex.Attachments[0].TypeUrl != spanContextTypeURL {
+			t.Errorf("TypeUrl = %q, want %q", ex.Attachments[0].TypeUrl, spanContextTypeURL)
+		}
+	})
+}